@@ -0,0 +1,214 @@
+/*
+ *
+ * Copyright 2023 puzzleblogserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package activitypub implements an optional ActivityPub outbox/inbox
+// subsystem allowing a puzzleblog instance to federate with the Fediverse.
+package activitypub
+
+import (
+	"context"
+	"crypto/rsa"
+	"fmt"
+	"time"
+
+	"github.com/dvaumoron/puzzleblogserver/mongopool"
+	mongoclient "github.com/dvaumoron/puzzlemongoclient"
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+const outboxCollectionName = "activitypub_outbox"
+const followerCollectionName = "activitypub_followers"
+const remoteUserCollectionName = "activitypub_remote_users"
+const blogKeyCollectionName = "activitypub_blog_keys"
+
+const blogIdKey = "blogId"
+const activityIdKey = "activityId"
+const actorIdKey = "actorId"
+const inboxKey = "inbox"
+const sharedInboxKey = "sharedInbox"
+const handleKey = "handle"
+const publishedAtKey = "publishedAt"
+
+const mongoCallMsg = "Failed during MongoDB call"
+const deliverFailMsg = "Failed to deliver ActivityPub activity"
+
+// ActivityType is one of the standard ActivityStreams verbs this subsystem emits or accepts.
+type ActivityType string
+
+const (
+	CreateActivity   ActivityType = "Create"
+	UpdateActivity   ActivityType = "Update"
+	DeleteActivity   ActivityType = "Delete"
+	FollowActivity   ActivityType = "Follow"
+	UndoActivity     ActivityType = "Undo"
+	LikeActivity     ActivityType = "Like"
+	AnnounceActivity ActivityType = "Announce"
+)
+
+// Article is the Note/Article object wrapping a blog post inside an activity.
+type Article struct {
+	Id        string `json:"id"`
+	Type      string `json:"type"`
+	AttrTo    string `json:"attributedTo"`
+	Title     string `json:"name,omitempty"`
+	Content   string `json:"content"`
+	Published string `json:"published"`
+}
+
+// Activity is a minimal ActivityStreams 2.0 activity envelope.
+type Activity struct {
+	Context string       `json:"@context"`
+	Id      string       `json:"id"`
+	Type    ActivityType `json:"type"`
+	Actor   string       `json:"actor"`
+	Object  any          `json:"object"`
+}
+
+// RemoteUser is a follower or target actor known from a previous interaction.
+type RemoteUser struct {
+	ActorId     string
+	Inbox       string
+	SharedInbox string
+	Handle      string
+}
+
+// Config groups the settings needed to run the federation subsystem for one instance.
+type Config struct {
+	Pool         *mongopool.Pool
+	DatabaseName string
+	BaseURL      string
+	Logger       *otelzap.Logger
+}
+
+// Publisher emits ActivityPub activities into per-blog outboxes and delivers
+// them asynchronously to known followers. A nil *Publisher disables federation.
+type Publisher struct {
+	pool         *mongopool.Pool
+	databaseName string
+	baseURL      string
+	logger       *otelzap.Logger
+}
+
+// New builds a Publisher from conf, or returns nil if federation is not configured.
+func New(conf Config) *Publisher {
+	if conf.BaseURL == "" {
+		return nil
+	}
+	return &Publisher{
+		pool: conf.Pool, databaseName: conf.DatabaseName,
+		baseURL: conf.BaseURL, logger: conf.Logger,
+	}
+}
+
+// ActorURL returns the actor id for the given blog, used as attributedTo/actor fields.
+func (p *Publisher) ActorURL(blogId uint64) string {
+	return fmt.Sprintf("%s/blogs/%d", p.baseURL, blogId)
+}
+
+// ArticleId returns the stable object id used for a post's Article/Note representation.
+func (p *Publisher) ArticleId(blogId, postId uint64) string {
+	return fmt.Sprintf("%s/posts/%d", p.ActorURL(blogId), postId)
+}
+
+// ToArticle wraps a post's title and text into the Article object published in activities.
+func (p *Publisher) ToArticle(blogId, postId uint64, title, text string) Article {
+	return Article{
+		Id: p.ArticleId(blogId, postId), Type: "Article", AttrTo: p.ActorURL(blogId),
+		Title: title, Content: text, Published: time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+// Publish wraps object into an activity of the given type, stores it in the blog's
+// outbox collection and delivers it to current followers in the background.
+func (p *Publisher) Publish(ctx context.Context, blogId uint64, activityType ActivityType, object any) {
+	logger := p.logger.Ctx(ctx)
+	database := p.pool.Client().Database(p.databaseName)
+	actor := p.ActorURL(blogId)
+	activityId := fmt.Sprintf("%s/activities/%s-%d", actor, activityType, time.Now().UnixNano())
+	activity := Activity{Context: "https://www.w3.org/ns/activitystreams", Id: activityId, Type: activityType, Actor: actor, Object: object}
+
+	outbox := bson.M{
+		blogIdKey: blogId, activityIdKey: activityId, "type": activityType,
+		"activity": activity, publishedAtKey: time.Now(),
+	}
+	if _, err := database.Collection(outboxCollectionName).InsertOne(ctx, outbox); err != nil {
+		logger.Error(mongoCallMsg, zap.Error(err))
+		return
+	}
+
+	followers, err := loadFollowers(ctx, database, blogId)
+	if err != nil {
+		logger.Error(mongoCallMsg, zap.Error(err))
+		return
+	}
+
+	key, err := ensureBlogKey(ctx, database, blogId)
+	if err != nil {
+		logger.Error(mongoCallMsg, zap.Error(err))
+		return
+	}
+
+	// deliveries happen after the RPC has already answered the caller
+	go p.deliverToAll(context.Background(), activity, followers, actor+"#main-key", key.PrivateKey)
+}
+
+func loadFollowers(ctx context.Context, database *mongo.Database, blogId uint64) ([]RemoteUser, error) {
+	cursor, err := database.Collection(followerCollectionName).Find(ctx, bson.D{{Key: blogIdKey, Value: blogId}})
+	if err != nil {
+		return nil, err
+	}
+
+	var results []bson.M
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	return mongoclient.ConvertSlice(results, convertToRemoteUser), nil
+}
+
+func convertToRemoteUser(user bson.M) RemoteUser {
+	actorId, _ := user[actorIdKey].(string)
+	inbox, _ := user[inboxKey].(string)
+	sharedInbox, _ := user[sharedInboxKey].(string)
+	handle, _ := user[handleKey].(string)
+	return RemoteUser{ActorId: actorId, Inbox: inbox, SharedInbox: sharedInbox, Handle: handle}
+}
+
+// deliverToAll posts activity to every follower inbox (deduplicated on shared inboxes),
+// HTTP-signing each request with the blog's own key so remote servers accept it,
+// and retrying any failed delivery with a short backoff.
+func (p *Publisher) deliverToAll(ctx context.Context, activity Activity, followers []RemoteUser, keyId string, privateKey *rsa.PrivateKey) {
+	logger := p.logger.Ctx(ctx)
+	seenInbox := map[string]bool{}
+	for _, follower := range followers {
+		inbox := follower.SharedInbox
+		if inbox == "" {
+			inbox = follower.Inbox
+		}
+		if seenInbox[inbox] {
+			continue
+		}
+		seenInbox[inbox] = true
+
+		if err := deliverWithRetry(ctx, inbox, activity, keyId, privateKey); err != nil {
+			logger.Error(deliverFailMsg, zap.String(inboxKey, inbox), zap.Error(err))
+		}
+	}
+}
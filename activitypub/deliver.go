@@ -0,0 +1,85 @@
+/*
+ *
+ * Copyright 2023 puzzleblogserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package activitypub
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const deliverMaxAttempts = 5
+const deliverBaseDelay = time.Second
+
+var errDeliverFailed = errors.New("activity delivery failed after retries")
+
+// deliverWithRetry posts activity to inbox, signed with keyId/privateKey, retrying
+// with an exponential backoff on any failure: a 4xx response is retried just like
+// a network error or a 5xx response.
+func deliverWithRetry(ctx context.Context, inbox string, activity Activity, keyId string, privateKey *rsa.PrivateKey) error {
+	body, err := json.Marshal(activity)
+	if err != nil {
+		return err
+	}
+
+	delay := deliverBaseDelay
+	for attempt := 0; attempt < deliverMaxAttempts; attempt++ {
+		if attempt != 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+			delay *= 2
+		}
+
+		if err = postActivity(ctx, inbox, body, keyId, privateKey); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", errDeliverFailed, err)
+}
+
+func postActivity(ctx context.Context, inbox string, body []byte, keyId string, privateKey *rsa.PrivateKey) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, inbox, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/activity+json")
+
+	if err = signRequest(req, keyId, privateKey); err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("inbox %s responded with status %d", inbox, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+/*
+ *
+ * Copyright 2023 puzzleblogserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package activitypub
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	mongoclient "github.com/dvaumoron/puzzlemongoclient"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+const likeCollectionName = "activitypub_likes"
+const announceCollectionName = "activitypub_announces"
+const replyCollectionName = "activitypub_replies"
+
+// Handler exposes the federation HTTP endpoints (webfinger, actor, outbox, inbox)
+// meant to be registered on the same mux as grpcserver.Make's health/metrics routes.
+type Handler struct {
+	publisher *Publisher
+}
+
+// NewHandler builds a Handler serving the federation endpoints for publisher.
+func NewHandler(publisher *Publisher) *Handler {
+	return &Handler{publisher: publisher}
+}
+
+// Routes registers the federation endpoints on mux.
+func (h *Handler) Routes(mux *http.ServeMux) {
+	mux.HandleFunc("/.well-known/webfinger", h.WebFinger)
+	mux.HandleFunc("/blogs/", h.Actor)
+	mux.HandleFunc("/blogs/outbox/", h.Outbox)
+	mux.HandleFunc("/blogs/inbox/", h.Inbox)
+}
+
+// WebFinger resolves acct:blog-<id>@host to the blog actor id.
+func (h *Handler) WebFinger(w http.ResponseWriter, r *http.Request) {
+	resource := r.URL.Query().Get("resource")
+	blogId, ok := parseBlogHandle(resource)
+	if !ok {
+		http.Error(w, "unknown resource", http.StatusNotFound)
+		return
+	}
+
+	actor := h.publisher.ActorURL(blogId)
+	writeJSON(w, "application/jrd+json", map[string]any{
+		"subject": resource,
+		"links": []map[string]string{
+			{"rel": "self", "type": "application/activity+json", "href": actor},
+		},
+	})
+}
+
+func parseBlogHandle(resource string) (uint64, bool) {
+	account := strings.TrimPrefix(resource, "acct:")
+	handle, _, found := strings.Cut(account, "@")
+	if !found {
+		return 0, false
+	}
+
+	idPart := strings.TrimPrefix(handle, "blog-")
+	blogId, err := strconv.ParseUint(idPart, 10, 64)
+	return blogId, err == nil
+}
+
+// Actor serves the ActivityPub actor document for a blog, including the
+// public key remote servers need to verify this instance's signed deliveries.
+func (h *Handler) Actor(w http.ResponseWriter, r *http.Request) {
+	blogId, ok := blogIdFromPath(r.URL.Path, "/blogs/")
+	if !ok {
+		http.Error(w, "unknown actor", http.StatusNotFound)
+		return
+	}
+
+	ctx := r.Context()
+	logger := h.publisher.logger.Ctx(ctx)
+	database := h.publisher.pool.Client().Database(h.publisher.databaseName)
+
+	key, err := ensureBlogKey(ctx, database, blogId)
+	if err != nil {
+		logger.Error(mongoCallMsg, zap.Error(err))
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	actor := h.publisher.ActorURL(blogId)
+	writeJSON(w, "application/activity+json", map[string]any{
+		"@context": []string{"https://www.w3.org/ns/activitystreams"},
+		"id":       actor,
+		"type":     "Organization",
+		"inbox":    h.publisher.baseURL + "/blogs/inbox/" + strconv.FormatUint(blogId, 10),
+		"outbox":   h.publisher.baseURL + "/blogs/outbox/" + strconv.FormatUint(blogId, 10),
+		"publicKey": map[string]string{
+			"id":           actor + "#main-key",
+			"owner":        actor,
+			"publicKeyPem": key.PublicKeyPem,
+		},
+	})
+}
+
+// Outbox lists the published activities for a blog.
+func (h *Handler) Outbox(w http.ResponseWriter, r *http.Request) {
+	blogId, ok := blogIdFromPath(r.URL.Path, "/blogs/outbox/")
+	if !ok {
+		http.Error(w, "unknown outbox", http.StatusNotFound)
+		return
+	}
+
+	ctx := r.Context()
+	logger := h.publisher.logger.Ctx(ctx)
+	collection := h.publisher.pool.Client().Database(h.publisher.databaseName).Collection(outboxCollectionName)
+	cursor, err := collection.Find(ctx, bson.D{{Key: blogIdKey, Value: blogId}})
+	if err != nil {
+		logger.Error(mongoCallMsg, zap.Error(err))
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	var results []bson.M
+	if err = cursor.All(ctx, &results); err != nil {
+		logger.Error(mongoCallMsg, zap.Error(err))
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	items := mongoclient.ConvertSlice(results, func(item bson.M) any { return item["activity"] })
+	writeJSON(w, "application/activity+json", map[string]any{
+		"@context":     "https://www.w3.org/ns/activitystreams",
+		"id":           h.publisher.baseURL + "/blogs/outbox/" + strconv.FormatUint(blogId, 10),
+		"type":         "OrderedCollection",
+		"totalItems":   len(items),
+		"orderedItems": items,
+	})
+}
+
+// Inbox accepts Follow/Undo/Like/Announce/Create activities from remote actors.
+func (h *Handler) Inbox(w http.ResponseWriter, r *http.Request) {
+	blogId, ok := blogIdFromPath(r.URL.Path, "/blogs/inbox/")
+	if !ok {
+		http.Error(w, "unknown inbox", http.StatusNotFound)
+		return
+	}
+
+	var activity Activity
+	if err := json.NewDecoder(r.Body).Decode(&activity); err != nil {
+		http.Error(w, "malformed activity", http.StatusBadRequest)
+		return
+	}
+
+	actor, err := fetchActor(r.Context(), activity.Actor)
+	if err != nil || verifyHTTPSignature(r, actor.PublicKeyPem) != nil {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	ctx := r.Context()
+	logger := h.publisher.logger.Ctx(ctx)
+	database := h.publisher.pool.Client().Database(h.publisher.databaseName)
+	if err := h.handleInboxActivity(ctx, database, blogId, activity, actor); err != nil {
+		logger.Error(mongoCallMsg, zap.Error(err))
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *Handler) handleInboxActivity(ctx context.Context, database *mongo.Database, blogId uint64, activity Activity, actor remoteActor) error {
+	switch activity.Type {
+	case FollowActivity:
+		return storeFollower(ctx, database, blogId, activity.Actor, actor)
+	case UndoActivity:
+		return removeFollower(ctx, database, blogId, activity.Actor)
+	case LikeActivity:
+		return recordEngagement(ctx, database, likeCollectionName, blogId, activity)
+	case AnnounceActivity:
+		return recordEngagement(ctx, database, announceCollectionName, blogId, activity)
+	case CreateActivity:
+		return recordEngagement(ctx, database, replyCollectionName, blogId, activity)
+	}
+	return nil
+}
+
+func storeFollower(ctx context.Context, database *mongo.Database, blogId uint64, actorId string, actor remoteActor) error {
+	filter := bson.D{{Key: blogIdKey, Value: blogId}, {Key: actorIdKey, Value: actorId}}
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: blogIdKey, Value: blogId}, {Key: actorIdKey, Value: actorId},
+		{Key: inboxKey, Value: actor.Inbox}, {Key: sharedInboxKey, Value: actor.SharedInbox},
+		{Key: handleKey, Value: actor.PreferredUsername},
+	}}}
+	_, err := database.Collection(followerCollectionName).UpdateOne(ctx, filter, update, mongoUpsert())
+	return err
+}
+
+func removeFollower(ctx context.Context, database *mongo.Database, blogId uint64, actorId string) error {
+	filter := bson.D{{Key: blogIdKey, Value: blogId}, {Key: actorIdKey, Value: actorId}}
+	_, err := database.Collection(followerCollectionName).DeleteOne(ctx, filter)
+	return err
+}
+
+func recordEngagement(ctx context.Context, database *mongo.Database, collectionName string, blogId uint64, activity Activity) error {
+	_, err := database.Collection(collectionName).InsertOne(ctx, bson.M{
+		blogIdKey: blogId, actorIdKey: activity.Actor, "activity": activity, publishedAtKey: time.Now(),
+	})
+	return err
+}
+
+func mongoUpsert() *options.UpdateOptions {
+	return options.Update().SetUpsert(true)
+}
+
+func blogIdFromPath(path, prefix string) (uint64, bool) {
+	blogId, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSuffix(path, "/"), prefix), 10, 64)
+	return blogId, err == nil
+}
+
+func writeJSON(w http.ResponseWriter, contentType string, body any) {
+	w.Header().Set("Content-Type", contentType)
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,115 @@
+/*
+ *
+ * Copyright 2023 puzzleblogserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package activitypub
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseSignatureHeader(t *testing.T) {
+	header := `keyId="https://example.com/actor#main-key",algorithm="rsa-sha256",headers="(request-target) host date",signature="YWJj"`
+	params, err := parseSignatureHeader(header)
+	if err != nil {
+		t.Fatalf("parseSignatureHeader returned an error: %v", err)
+	}
+
+	want := map[string]string{
+		"keyId":     "https://example.com/actor#main-key",
+		"algorithm": "rsa-sha256",
+		"headers":   "(request-target) host date",
+		"signature": "YWJj",
+	}
+	for key, value := range want {
+		if params[key] != value {
+			t.Errorf("parseSignatureHeader()[%q] = %q, want %q", key, params[key], value)
+		}
+	}
+}
+
+func TestParseSignatureHeaderDefaultsHeaders(t *testing.T) {
+	params, err := parseSignatureHeader(`keyId="k",algorithm="rsa-sha256",signature="YWJj"`)
+	if err != nil {
+		t.Fatalf("parseSignatureHeader returned an error: %v", err)
+	}
+	if params["headers"] != "(request-target) host date" {
+		t.Errorf(`parseSignatureHeader()["headers"] = %q, want the default`, params["headers"])
+	}
+}
+
+func TestParseSignatureHeaderRejectsMalformed(t *testing.T) {
+	for _, header := range []string{"", "garbage", `algorithm="rsa-sha256"`, `signature`} {
+		if _, err := parseSignatureHeader(header); err != errMalformedSignature {
+			t.Errorf("parseSignatureHeader(%q) error = %v, want errMalformedSignature", header, err)
+		}
+	}
+}
+
+func TestBuildSigningString(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "https://example.com/blogs/inbox/1", nil)
+	req.Host = "example.com"
+	req.Header.Set("Date", "Tue, 07 Jun 2014 20:51:35 GMT")
+
+	got, err := buildSigningString(req, []string{"(request-target)", "host", "date"})
+	if err != nil {
+		t.Fatalf("buildSigningString returned an error: %v", err)
+	}
+
+	want := "(request-target): post /blogs/inbox/1\nhost: example.com\ndate: Tue, 07 Jun 2014 20:51:35 GMT"
+	if got != want {
+		t.Errorf("buildSigningString() = %q, want %q", got, want)
+	}
+}
+
+func TestBuildSigningStringMissingHeader(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	if _, err := buildSigningString(req, []string{"date"}); err == nil {
+		t.Error("buildSigningString with a missing header should return an error")
+	}
+}
+
+func TestResolvePinnedAddrRejectsNonHTTPS(t *testing.T) {
+	if _, err := resolvePinnedAddr(context.Background(), "http://example.com/actor"); err != errForbiddenActorURL {
+		t.Errorf("resolvePinnedAddr(http://...) error = %v, want errForbiddenActorURL", err)
+	}
+}
+
+func TestResolvePinnedAddrRejectsEmptyHost(t *testing.T) {
+	if _, err := resolvePinnedAddr(context.Background(), "https:///actor"); err != errForbiddenActorURL {
+		t.Errorf("resolvePinnedAddr(https:///actor) error = %v, want errForbiddenActorURL", err)
+	}
+}
+
+func TestIsForbiddenIP(t *testing.T) {
+	forbidden := []string{"127.0.0.1", "10.0.0.1", "192.168.1.1", "169.254.1.1", "::1", "0.0.0.0"}
+	for _, raw := range forbidden {
+		if ip := net.ParseIP(raw); !isForbiddenIP(ip) {
+			t.Errorf("isForbiddenIP(%q) = false, want true", raw)
+		}
+	}
+
+	allowed := []string{"93.184.216.34", "8.8.8.8", "2001:4860:4860::8888"}
+	for _, raw := range allowed {
+		if ip := net.ParseIP(raw); isForbiddenIP(ip) {
+			t.Errorf("isForbiddenIP(%q) = true, want false", raw)
+		}
+	}
+}
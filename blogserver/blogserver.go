@@ -20,8 +20,13 @@ package blogserver
 import (
 	"context"
 	"errors"
+	"regexp"
 	"strings"
+	"time"
 
+	"github.com/dvaumoron/puzzleblogserver/activitypub"
+	"github.com/dvaumoron/puzzleblogserver/blogserver/migrations"
+	"github.com/dvaumoron/puzzleblogserver/mongopool"
 	pb "github.com/dvaumoron/puzzleblogservice"
 	mongoclient "github.com/dvaumoron/puzzlemongoclient"
 	"github.com/uptrace/opentelemetry-go-extra/otelzap"
@@ -34,52 +39,76 @@ import (
 const BlogKey = "puzzleBlog"
 
 const collectionName = "posts"
+const revisionCollectionName = "post_revisions"
 
 const blogIdKey = "blogId"
 const postIdKey = "postId"
 const userIdKey = "userId"
 const titleKey = "title"
 const textKey = "text"
+const revisionIdKey = "revisionId"
+const editedAtKey = "editedAt"
+const editorUserIdKey = "editorUserId"
+const scoreKey = "score"
+const statusKey = "status"
+const publishAtKey = "publishAt"
+
+const defaultTextLanguage = "english"
 
 const mongoCallMsg = "Failed during MongoDB call"
 
 var errInternal = errors.New("internal service error")
 var errNoPost = errors.New("no blog post with requested ids")
+var errNoRevision = errors.New("no post revision with requested ids")
 
 var optsMaxPostId = options.FindOne().SetSort(bson.D{{Key: postIdKey, Value: -1}}).SetProjection(bson.D{{Key: postIdKey, Value: true}})
+var optsMaxRevisionId = options.FindOne().SetSort(bson.D{{Key: revisionIdKey, Value: -1}}).SetProjection(bson.D{{Key: revisionIdKey, Value: true}})
+var optsRevisionsOrder = options.Find().SetSort(bson.D{{Key: revisionIdKey, Value: -1}})
 
 // server is used to implement puzzleblogservice.BlogServer
 type server struct {
 	pb.UnimplementedBlogServer
-	clientOptions *options.ClientOptions
-	databaseName  string
-	logger        *otelzap.Logger
+	mongoPool    *mongopool.Pool
+	databaseName string
+	logger       *otelzap.Logger
+	federation   *activitypub.Publisher
 }
 
-func New(clientOptions *options.ClientOptions, databaseName string, logger *otelzap.Logger) pb.BlogServer {
-	return server{clientOptions: clientOptions, databaseName: databaseName, logger: logger}
+// New builds a BlogServer sharing pool with the rest of the instance (in
+// particular the optional activitypub federation package), applying any
+// pending schema migration beforehand. federation may be nil to disable
+// ActivityPub publishing. The returned server must be Close'd on shutdown.
+func New(pool *mongopool.Pool, databaseName string, logger *otelzap.Logger, federation *activitypub.Publisher) (*server, error) {
+	ctx := context.Background()
+	if err := migrations.Apply(ctx, pool.Client().Database(databaseName), logger); err != nil {
+		return nil, err
+	}
+
+	s := &server{mongoPool: pool, databaseName: databaseName, logger: logger, federation: federation}
+	s.startScheduledPublisher(context.Background())
+	return s, nil
 }
 
-func (s server) CreatePost(ctx context.Context, request *pb.CreateRequest) (*pb.Response, error) {
+func (s *server) CreatePost(ctx context.Context, request *pb.CreateRequest) (*pb.Response, error) {
 	logger := s.logger.Ctx(ctx)
-	client, err := mongo.Connect(ctx, s.clientOptions)
-	if err != nil {
-		logger.Error(mongoCallMsg, zap.Error(err))
-		return nil, errInternal
-	}
-	defer mongoclient.Disconnect(client, logger)
-
-	collection := client.Database(s.databaseName).Collection(collectionName)
+	collection := s.mongoPool.Client().Database(s.databaseName).Collection(collectionName)
 
 	blogId := request.BlogId
+	status := request.Status
+	if status == pb.PostStatus_UNSPECIFIED {
+		status = pb.PostStatus_PUBLISHED
+	}
+
 	filter := bson.D{{Key: blogIdKey, Value: blogId}}
 	post := bson.M{
 		blogIdKey: blogId, userIdKey: request.UserId,
 		titleKey: request.Title, textKey: request.Text,
+		statusKey: status, publishAtKey: request.PublishAt,
 	}
 
 	// rely on the mongo server to ensure there will be no duplicate
 	newPostId := uint64(1)
+	var err error
 
 GeneratePostIdStep:
 	var result bson.D
@@ -108,24 +137,25 @@ CreatePostStep:
 		logger.Error(mongoCallMsg, zap.Error(err))
 		return nil, errInternal
 	}
+
+	if s.federation != nil && status == pb.PostStatus_PUBLISHED {
+		s.federation.Publish(ctx, blogId, activitypub.CreateActivity, s.federation.ToArticle(blogId, newPostId, request.Title, request.Text))
+	}
 	return &pb.Response{Success: true, Id: newPostId}, nil
 }
 
-func (s server) GetPost(ctx context.Context, request *pb.IdRequest) (*pb.Content, error) {
+func (s *server) GetPost(ctx context.Context, request *pb.IdRequest) (*pb.Content, error) {
 	logger := s.logger.Ctx(ctx)
-	client, err := mongo.Connect(ctx, s.clientOptions)
-	if err != nil {
-		logger.Error(mongoCallMsg, zap.Error(err))
-		return nil, errInternal
-	}
-	defer mongoclient.Disconnect(client, logger)
-
-	collection := client.Database(s.databaseName).Collection(collectionName)
+	collection := s.mongoPool.Client().Database(s.databaseName).Collection(collectionName)
 
+	// only a published post can be looked up by id: postId is a small sequential
+	// counter, so exposing draft/scheduled/unlisted posts here would let anyone
+	// read them ahead of publication just by guessing the next id
 	var result bson.M
-	err = collection.FindOne(
-		ctx, bson.D{{Key: blogIdKey, Value: request.BlogId}, {Key: postIdKey, Value: request.PostId}},
-	).Decode(&result)
+	err := collection.FindOne(ctx, bson.D{
+		{Key: blogIdKey, Value: request.BlogId}, {Key: postIdKey, Value: request.PostId},
+		{Key: statusKey, Value: pb.PostStatus_PUBLISHED},
+	}).Decode(&result)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return nil, errNoPost
@@ -137,19 +167,38 @@ func (s server) GetPost(ctx context.Context, request *pb.IdRequest) (*pb.Content
 	return convertToContent(result), nil
 }
 
-func (s server) GetPosts(ctx context.Context, request *pb.SearchRequest) (*pb.Contents, error) {
+func (s *server) GetPosts(ctx context.Context, request *pb.SearchRequest) (*pb.Contents, error) {
 	logger := s.logger.Ctx(ctx)
-	client, err := mongo.Connect(ctx, s.clientOptions)
-	if err != nil {
-		logger.Error(mongoCallMsg, zap.Error(err))
-		return nil, errInternal
+	collection := s.mongoPool.Client().Database(s.databaseName).Collection(collectionName)
+	filters := bson.D{{Key: blogIdKey, Value: request.BlogId}}
+	if request.IncludeDrafts {
+		if request.Status != pb.PostStatus_UNSPECIFIED {
+			filters = append(filters, bson.E{Key: statusKey, Value: request.Status})
+		}
+	} else {
+		filters = append(filters, bson.E{Key: statusKey, Value: pb.PostStatus_PUBLISHED})
 	}
-	defer mongoclient.Disconnect(client, logger)
 
-	collection := client.Database(s.databaseName).Collection(collectionName)
-	filters := bson.D{{Key: blogIdKey, Value: request.BlogId}}
+	paginate := options.Find()
 	if filter := request.Filter; filter != "" {
-		filters = append(filters, bson.E{Key: titleKey, Value: buildRegexFilter(filter)})
+		switch request.Mode {
+		case pb.SearchRequest_TEXT:
+			language := request.Language
+			if language == "" {
+				language = defaultTextLanguage
+			}
+			filters = append(filters, bson.E{Key: "$text", Value: bson.D{{Key: "$search", Value: filter}, {Key: "$language", Value: language}}})
+			paginate.SetProjection(bson.D{{Key: scoreKey, Value: bson.D{{Key: "$meta", Value: "textScore"}}}})
+			paginate.SetSort(bson.D{{Key: scoreKey, Value: bson.D{{Key: "$meta", Value: "textScore"}}}, {Key: postIdKey, Value: -1}})
+		case pb.SearchRequest_PREFIX:
+			filters = append(filters, buildFieldsFilter(request.Fields, buildPrefixFilter(filter))...)
+			paginate.SetSort(bson.D{{Key: postIdKey, Value: -1}})
+		default:
+			filters = append(filters, buildFieldsFilter(request.Fields, buildRegexFilter(filter))...)
+			paginate.SetSort(bson.D{{Key: postIdKey, Value: -1}})
+		}
+	} else {
+		paginate.SetSort(bson.D{{Key: postIdKey, Value: -1}})
 	}
 
 	total, err := collection.CountDocuments(ctx, filters)
@@ -158,7 +207,6 @@ func (s server) GetPosts(ctx context.Context, request *pb.SearchRequest) (*pb.Co
 		return nil, errInternal
 	}
 
-	paginate := options.Find().SetSort(bson.D{{Key: postIdKey, Value: -1}})
 	start := int64(request.Start)
 	paginate.SetSkip(start).SetLimit(int64(request.End) - start)
 
@@ -176,24 +224,155 @@ func (s server) GetPosts(ctx context.Context, request *pb.SearchRequest) (*pb.Co
 	return &pb.Contents{List: mongoclient.ConvertSlice(results, convertToContent), Total: uint64(total)}, nil
 }
 
-func (s server) DeletePost(ctx context.Context, request *pb.IdRequest) (*pb.Response, error) {
+func (s *server) UpdatePost(ctx context.Context, request *pb.UpdateRequest) (*pb.Response, error) {
 	logger := s.logger.Ctx(ctx)
-	client, err := mongo.Connect(ctx, s.clientOptions)
+	database := s.mongoPool.Client().Database(s.databaseName)
+	collection := database.Collection(collectionName)
+
+	blogId, postId := request.BlogId, request.PostId
+	filter := bson.D{{Key: blogIdKey, Value: blogId}, {Key: postIdKey, Value: postId}}
+
+	var previous bson.M
+	var err error
+	if err = collection.FindOne(ctx, filter).Decode(&previous); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, errNoPost
+		}
+
+		logger.Error(mongoCallMsg, zap.Error(err))
+		return nil, errInternal
+	}
+
+	revisionCollection := database.Collection(revisionCollectionName)
+	revisionFilter := bson.D{{Key: blogIdKey, Value: blogId}, {Key: postIdKey, Value: postId}}
+	revision := bson.M{
+		blogIdKey: blogId, postIdKey: postId, editorUserIdKey: request.EditorUserId,
+		titleKey: previous[titleKey], textKey: previous[textKey], editedAtKey: time.Now(),
+	}
+
+	// rely on the mongo server to ensure there will be no duplicate
+	newRevisionId := uint64(1)
+
+GenerateRevisionIdStep:
+	var result bson.D
+	err = revisionCollection.FindOne(ctx, revisionFilter, optsMaxRevisionId).Decode(&result)
 	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			goto CreateRevisionStep
+		}
+
+		logger.Error(mongoCallMsg, zap.Error(err))
+		return nil, errInternal
+	}
+
+	// call [1] to get revisionId because result has only the id and one field
+	newRevisionId = mongoclient.ExtractUint64(result[1].Value) + 1
+
+CreateRevisionStep:
+	revision[revisionIdKey] = newRevisionId
+	if _, err = revisionCollection.InsertOne(ctx, revision); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			// retry
+			goto GenerateRevisionIdStep
+		}
+
 		logger.Error(mongoCallMsg, zap.Error(err))
 		return nil, errInternal
 	}
-	defer mongoclient.Disconnect(client, logger)
 
-	collection := client.Database(s.databaseName).Collection(collectionName)
+	status := request.Status
+	if status == pb.PostStatus_UNSPECIFIED {
+		status = pb.PostStatus(mongoclient.ExtractUint64(previous[statusKey]))
+		if status == pb.PostStatus_UNSPECIFIED {
+			status = pb.PostStatus_PUBLISHED
+		}
+	}
+
+	publishAt := request.PublishAt
+	if publishAt == 0 {
+		publishAt = mongoclient.ExtractUint64(previous[publishAtKey])
+	}
 
-	_, err = collection.DeleteMany(
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: titleKey, Value: request.Title}, {Key: textKey, Value: request.Text},
+		{Key: statusKey, Value: status}, {Key: publishAtKey, Value: publishAt},
+	}}}
+	// FindOneAndUpdate (rather than UpdateOne) so a post deleted between the
+	// FindOne above and here is detected instead of silently reporting success
+	// over a revision that now points at nothing.
+	if err = collection.FindOneAndUpdate(ctx, filter, update).Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, errNoPost
+		}
+
+		logger.Error(mongoCallMsg, zap.Error(err))
+		return nil, errInternal
+	}
+
+	if s.federation != nil && status == pb.PostStatus_PUBLISHED {
+		s.federation.Publish(ctx, blogId, activitypub.UpdateActivity, s.federation.ToArticle(blogId, postId, request.Title, request.Text))
+	}
+	return &pb.Response{Success: true, Id: postId}, nil
+}
+
+func (s *server) ListRevisions(ctx context.Context, request *pb.RevisionsRequest) (*pb.Revisions, error) {
+	logger := s.logger.Ctx(ctx)
+	collection := s.mongoPool.Client().Database(s.databaseName).Collection(revisionCollectionName)
+	filter := bson.D{{Key: blogIdKey, Value: request.BlogId}, {Key: postIdKey, Value: request.PostId}}
+
+	cursor, err := collection.Find(ctx, filter, optsRevisionsOrder)
+	if err != nil {
+		logger.Error(mongoCallMsg, zap.Error(err))
+		return nil, errInternal
+	}
+
+	var results []bson.M
+	if err = cursor.All(ctx, &results); err != nil {
+		logger.Error(mongoCallMsg, zap.Error(err))
+		return nil, errInternal
+	}
+	return &pb.Revisions{List: mongoclient.ConvertSlice(results, convertToRevision)}, nil
+}
+
+func (s *server) GetRevision(ctx context.Context, request *pb.RevisionRequest) (*pb.Revision, error) {
+	logger := s.logger.Ctx(ctx)
+	collection := s.mongoPool.Client().Database(s.databaseName).Collection(revisionCollectionName)
+
+	var result bson.M
+	err := collection.FindOne(ctx, bson.D{
+		{Key: blogIdKey, Value: request.BlogId}, {Key: postIdKey, Value: request.PostId},
+		{Key: revisionIdKey, Value: request.RevisionId},
+	}).Decode(&result)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, errNoRevision
+		}
+
+		logger.Error(mongoCallMsg, zap.Error(err))
+		return nil, errInternal
+	}
+	return convertToRevision(result), nil
+}
+
+func (s *server) DeletePost(ctx context.Context, request *pb.IdRequest) (*pb.Response, error) {
+	logger := s.logger.Ctx(ctx)
+	collection := s.mongoPool.Client().Database(s.databaseName).Collection(collectionName)
+
+	var deleted bson.M
+	err := collection.FindOneAndDelete(
 		ctx, bson.D{{Key: blogIdKey, Value: request.BlogId}, {Key: postIdKey, Value: request.PostId}},
-	)
+	).Decode(&deleted)
 	if err != nil && err != mongo.ErrNoDocuments {
 		logger.Error(mongoCallMsg, zap.Error(err))
 		return nil, errInternal
 	}
+
+	// mirror CreatePost/UpdatePost: only a published post was ever seen by
+	// followers, so only a published post should emit a federated Delete
+	status := pb.PostStatus(mongoclient.ExtractUint64(deleted[statusKey]))
+	if s.federation != nil && status == pb.PostStatus_PUBLISHED {
+		s.federation.Publish(ctx, request.BlogId, activitypub.DeleteActivity, s.federation.ArticleId(request.BlogId, request.PostId))
+	}
 	return &pb.Response{Success: true}, nil
 }
 
@@ -204,18 +383,64 @@ func convertToContent(post bson.M) *pb.Content {
 		PostId: mongoclient.ExtractUint64(post[postIdKey]),
 		UserId: mongoclient.ExtractUint64(post[userIdKey]),
 		Title:  title, Text: text, CreatedAt: mongoclient.ExtractCreateDate(post).Unix(),
+		Status: pb.PostStatus(mongoclient.ExtractUint64(post[statusKey])), PublishAt: mongoclient.ExtractUint64(post[publishAtKey]),
 	}
 }
 
+func convertToRevision(revision bson.M) *pb.Revision {
+	title, _ := revision[titleKey].(string)
+	text, _ := revision[textKey].(string)
+	editedAt, _ := revision[editedAtKey].(time.Time)
+	return &pb.Revision{
+		RevisionId:   mongoclient.ExtractUint64(revision[revisionIdKey]),
+		EditorUserId: mongoclient.ExtractUint64(revision[editorUserIdKey]),
+		Title:        title, Text: text, EditedAt: editedAt.Unix(),
+	}
+}
+
+// buildFieldsFilter applies valueFilter to each of fields (title only, by default),
+// combining several fields with $or.
+func buildFieldsFilter(fields []string, valueFilter bson.D) bson.D {
+	if len(fields) == 0 {
+		fields = []string{titleKey}
+	}
+	if len(fields) == 1 {
+		return bson.D{{Key: fields[0], Value: valueFilter}}
+	}
+
+	orClauses := make(bson.A, len(fields))
+	for i, field := range fields {
+		orClauses[i] = bson.D{{Key: field, Value: valueFilter}}
+	}
+	return bson.D{{Key: "$or", Value: orClauses}}
+}
+
+// buildRegexFilter turns a SQL-LIKE style filter (where "%" is a wildcard) into an
+// unanchored, metacharacter-escaped regex, so user input can't be used to build
+// arbitrary (and possibly catastrophically slow) patterns.
 func buildRegexFilter(filter string) bson.D {
-	filter = strings.ReplaceAll(filter, "%", ".*")
+	escaped := escapeWildcardFilter(filter)
 	var regexBuilder strings.Builder
-	if strings.Index(filter, ".*") != 0 {
+	if !strings.HasPrefix(escaped, ".*") {
 		regexBuilder.WriteString(".*")
 	}
-	regexBuilder.WriteString(filter)
-	if strings.LastIndex(filter, ".*") != len(filter)-2 {
+	regexBuilder.WriteString(escaped)
+	if !strings.HasSuffix(escaped, ".*") {
 		regexBuilder.WriteString(".*")
 	}
 	return bson.D{{Key: "$regex", Value: regexBuilder.String()}}
 }
+
+// buildPrefixFilter turns a SQL-LIKE style filter into an anchored, escaped regex
+// that can use a standard (non-text) index on the searched field.
+func buildPrefixFilter(filter string) bson.D {
+	return bson.D{{Key: "$regex", Value: "^" + escapeWildcardFilter(filter)}}
+}
+
+func escapeWildcardFilter(filter string) string {
+	segments := strings.Split(filter, "%")
+	for i, segment := range segments {
+		segments[i] = regexp.QuoteMeta(segment)
+	}
+	return strings.Join(segments, ".*")
+}
@@ -0,0 +1,102 @@
+/*
+ *
+ * Copyright 2023 puzzleblogserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package blogserver
+
+import (
+	"regexp"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestEscapeWildcardFilter(t *testing.T) {
+	cases := map[string]string{
+		"hello":  "hello",
+		"hel%lo": "hel.*lo",
+		"a.b(c)": `a\.b\(c\)`,
+		"%":      ".*",
+		"%a%b%":  ".*a.*b.*",
+		"":       "",
+		"a.*b":   `a\.\*b`,
+	}
+	for filter, want := range cases {
+		if got := escapeWildcardFilter(filter); got != want {
+			t.Errorf("escapeWildcardFilter(%q) = %q, want %q", filter, got, want)
+		}
+	}
+}
+
+func TestEscapeWildcardFilterNeverBreaksCompile(t *testing.T) {
+	for _, filter := range []string{"(", ")", "[", "a(b", "a[b]c", "%(%)%"} {
+		if _, err := regexp.Compile(escapeWildcardFilter(filter)); err != nil {
+			t.Errorf("escapeWildcardFilter(%q) produced an uncompilable regex: %v", filter, err)
+		}
+	}
+}
+
+func TestBuildRegexFilter(t *testing.T) {
+	cases := map[string]string{
+		"hello":   ".*hello.*",
+		"%hello":  ".*hello.*",
+		"hello%":  ".*hello.*",
+		"%hello%": ".*hello.*",
+	}
+	for filter, want := range cases {
+		got := buildRegexFilter(filter)
+		if len(got) != 1 || got[0].Key != "$regex" || got[0].Value != want {
+			t.Errorf("buildRegexFilter(%q) = %#v, want $regex %q", filter, got, want)
+		}
+	}
+}
+
+func TestBuildRegexFilterEscapesMetacharacters(t *testing.T) {
+	got := buildRegexFilter("a(b")
+	want := `.*a\(b.*`
+	if len(got) != 1 || got[0].Value != want {
+		t.Errorf("buildRegexFilter(%q) = %#v, want $regex %q", "a(b", got, want)
+	}
+}
+
+func TestBuildPrefixFilter(t *testing.T) {
+	got := buildPrefixFilter("he%lo")
+	want := "^he.*lo"
+	if len(got) != 1 || got[0].Key != "$regex" || got[0].Value != want {
+		t.Errorf("buildPrefixFilter(%q) = %#v, want $regex %q", "he%lo", got, want)
+	}
+}
+
+func TestBuildFieldsFilterDefaultsToTitle(t *testing.T) {
+	valueFilter := buildPrefixFilter("abc")
+	got := buildFieldsFilter(nil, valueFilter)
+	if len(got) != 1 || got[0].Key != titleKey {
+		t.Errorf("buildFieldsFilter(nil, ...) = %#v, want filter on %q", got, titleKey)
+	}
+}
+
+func TestBuildFieldsFilterCombinesWithOr(t *testing.T) {
+	valueFilter := buildPrefixFilter("abc")
+	got := buildFieldsFilter([]string{titleKey, textKey}, valueFilter)
+	if len(got) != 1 || got[0].Key != "$or" {
+		t.Fatalf("buildFieldsFilter with 2 fields = %#v, want a single $or clause", got)
+	}
+
+	orClauses, ok := got[0].Value.(bson.A)
+	if !ok || len(orClauses) != 2 {
+		t.Fatalf("buildFieldsFilter $or value = %#v, want a 2-element bson.A", got[0].Value)
+	}
+}
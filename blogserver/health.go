@@ -0,0 +1,50 @@
+/*
+ *
+ * Copyright 2023 puzzleblogserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package blogserver
+
+import (
+	"context"
+	"net/http"
+)
+
+// reportMongoHealth writes the outcome of the last background ping, backing
+// both HealthHandler and ReadyHandler: this service has a single health signal,
+// the pooled mongo client's reachability.
+func (s *server) reportMongoHealth(w http.ResponseWriter) {
+	if !s.mongoPool.Healthy() {
+		http.Error(w, "mongo connection unhealthy", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// HealthHandler reports the outcome of the last background ping.
+func (s *server) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	s.reportMongoHealth(w)
+}
+
+// ReadyHandler reports the outcome of the last background ping.
+func (s *server) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	s.reportMongoHealth(w)
+}
+
+// Close releases the pooled mongo connection. It must be called once on shutdown.
+func (s *server) Close(ctx context.Context) error {
+	return s.mongoPool.Disconnect(ctx)
+}
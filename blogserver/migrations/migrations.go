@@ -0,0 +1,234 @@
+/*
+ *
+ * Copyright 2023 puzzleblogserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package migrations declares the schema_migrations applied on startup and the
+// mongo.IndexModels each one requires, following the migrate.Version pattern.
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+const schemaMigrationsCollectionName = "schema_migrations"
+const lockCollectionName = "schema_migrations_lock"
+const lockId = "migrations"
+
+// lockStaleAfter bounds how long a holder may keep the migration lock before it
+// is considered abandoned (e.g. the process crashed between acquiring the lock
+// and running its deferred unlock) and taken over by the next caller.
+const lockStaleAfter = 2 * time.Minute
+
+// lockAcquireTimeout bounds a single acquireLock call, so a startup fails loudly
+// instead of hanging forever behind a lock nothing will ever release.
+const lockAcquireTimeout = 30 * time.Second
+
+const versionKey = "version"
+const appliedAtKey = "appliedAt"
+
+const postsTitleTextIndexName = "posts_blogId_title_text"
+
+// mongoIndexNotFound is the server error code returned when dropping an index
+// that does not exist (e.g. a migration re-run after a partial failure).
+const mongoIndexNotFound = 27
+
+// Version is a single schema migration: a semver version, the indexes it requires
+// and the data transformation (if any) it applies.
+type Version struct {
+	Version string
+	Up      func(ctx context.Context, db *mongo.Database) error
+	Indexes map[string][]mongo.IndexModel
+}
+
+// versions lists the registered migrations, in the order they must be applied.
+var versions = []Version{
+	{
+		Version: "1.0.0",
+		Indexes: map[string][]mongo.IndexModel{
+			"posts": {
+				{Keys: bson.D{{Key: "blogId", Value: 1}, {Key: "postId", Value: -1}}, Options: options.Index().SetUnique(true)},
+				{Keys: bson.D{{Key: "blogId", Value: 1}, {Key: "title", Value: "text"}}, Options: options.Index().SetName(postsTitleTextIndexName)},
+				{Keys: bson.D{{Key: "blogId", Value: 1}, {Key: "createdAt", Value: -1}}},
+			},
+			"post_revisions": {
+				{Keys: bson.D{{Key: "blogId", Value: 1}, {Key: "postId", Value: 1}, {Key: "revisionId", Value: -1}}, Options: options.Index().SetUnique(true)},
+			},
+		},
+	},
+	{
+		// replaces the title-only text index with a compound one covering the post
+		// body too, so $text search matches on content and not just the title.
+		Version: "1.1.0",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection("posts").Indexes().DropOne(ctx, postsTitleTextIndexName)
+			var cmdErr mongo.CommandError
+			if err != nil && !(errors.As(err, &cmdErr) && cmdErr.Code == mongoIndexNotFound) {
+				return err
+			}
+			return nil
+		},
+		Indexes: map[string][]mongo.IndexModel{
+			"posts": {
+				{
+					Keys:    bson.D{{Key: "blogId", Value: 1}, {Key: "title", Value: "text"}, {Key: "text", Value: "text"}},
+					Options: options.Index().SetName(postsTitleTextIndexName),
+				},
+			},
+		},
+	},
+	{
+		// enforces at the database level what ensureBlogKey's upsert-then-reread
+		// already assumes: at most one signing keypair per blog, and at most one
+		// follower record per (blog, remote actor) pair.
+		Version: "1.2.0",
+		Indexes: map[string][]mongo.IndexModel{
+			"activitypub_blog_keys": {
+				{Keys: bson.D{{Key: "blogId", Value: 1}}, Options: options.Index().SetUnique(true)},
+			},
+			"activitypub_followers": {
+				{Keys: bson.D{{Key: "blogId", Value: 1}, {Key: "actorId", Value: 1}}, Options: options.Index().SetUnique(true)},
+			},
+		},
+	},
+}
+
+// Apply runs every pending migration, in order, under an advisory lock, then
+// creates or updates the indexes each migration declares. It is idempotent: it
+// can be called on every startup.
+func Apply(ctx context.Context, db *mongo.Database, logger *otelzap.Logger) error {
+	unlock, err := acquireLock(ctx, db)
+	if err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %w", err)
+	}
+	defer unlock(ctx)
+
+	applied, err := appliedVersions(ctx, db)
+	if err != nil {
+		return fmt.Errorf("failed to read applied migrations: %w", err)
+	}
+
+	for _, version := range versions {
+		if applied[version.Version] {
+			continue
+		}
+
+		if version.Up != nil {
+			if err = version.Up(ctx, db); err != nil {
+				return fmt.Errorf("migration %s failed: %w", version.Version, err)
+			}
+		}
+
+		for collectionName, indexes := range version.Indexes {
+			if _, err = db.Collection(collectionName).Indexes().CreateMany(ctx, indexes); err != nil {
+				return fmt.Errorf("migration %s failed to create indexes on %s: %w", version.Version, collectionName, err)
+			}
+		}
+
+		record := bson.M{versionKey: version.Version, appliedAtKey: time.Now()}
+		if _, err = db.Collection(schemaMigrationsCollectionName).InsertOne(ctx, record); err != nil {
+			return fmt.Errorf("migration %s failed to record applied version: %w", version.Version, err)
+		}
+		logger.Info("Applied schema migration", zap.String(versionKey, version.Version))
+	}
+	return nil
+}
+
+func appliedVersions(ctx context.Context, db *mongo.Database) (map[string]bool, error) {
+	cursor, err := db.Collection(schemaMigrationsCollectionName).Find(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+
+	var results []bson.M
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+
+	applied := make(map[string]bool, len(results))
+	for _, result := range results {
+		if version, ok := result[versionKey].(string); ok {
+			applied[version] = true
+		}
+	}
+	return applied, nil
+}
+
+// acquireLock takes a simple advisory lock by inserting a well-known document,
+// relying on the mongo server to reject concurrent holders with a duplicate key
+// error. A lock older than lockStaleAfter is treated as abandoned and taken
+// over rather than waited on, and the whole attempt is bounded by
+// lockAcquireTimeout so a startup fails with a clear error instead of hanging
+// forever. It returns an unlock function that must be deferred.
+func acquireLock(ctx context.Context, db *mongo.Database) (func(context.Context), error) {
+	ctx, cancel := context.WithTimeout(ctx, lockAcquireTimeout)
+	defer cancel()
+
+	collection := db.Collection(lockCollectionName)
+	for {
+		_, err := collection.InsertOne(ctx, bson.M{"_id": lockId, "lockedAt": time.Now()})
+		if err == nil {
+			break
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, err
+		}
+
+		tookOver, err := takeOverStaleLock(ctx, collection)
+		if err != nil {
+			return nil, err
+		}
+		if tookOver {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timed out waiting for migration lock: %w", ctx.Err())
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+
+	return func(ctx context.Context) {
+		_, _ = collection.DeleteOne(ctx, bson.M{"_id": lockId})
+	}, nil
+}
+
+// takeOverStaleLock replaces the lock document if it is still older than
+// lockStaleAfter at the time of the update, as if its holder had crashed
+// without unlocking. Filtering on lockedAt makes this a no-op (matched count
+// 0) if another caller took the lock over concurrently.
+func takeOverStaleLock(ctx context.Context, collection *mongo.Collection) (bool, error) {
+	filter := bson.D{
+		{Key: "_id", Value: lockId},
+		{Key: "lockedAt", Value: bson.D{{Key: "$lt", Value: time.Now().Add(-lockStaleAfter)}}},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "lockedAt", Value: time.Now()}}}}
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
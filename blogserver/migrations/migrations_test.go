@@ -0,0 +1,80 @@
+/*
+ *
+ * Copyright 2023 puzzleblogserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package migrations
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestTakeOverStaleLockReplacesAnAbandonedLock(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("stale lock is taken over", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(
+			bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1},
+		))
+
+		tookOver, err := takeOverStaleLock(mt.Ctx, mt.Coll)
+		if err != nil {
+			t.Fatalf("takeOverStaleLock returned an error: %v", err)
+		}
+		if !tookOver {
+			t.Error("takeOverStaleLock() = false, want true when the server reports a match")
+		}
+	})
+}
+
+func TestTakeOverStaleLockLeavesALiveLockAlone(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("live lock is left alone", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(
+			bson.E{Key: "n", Value: 0}, bson.E{Key: "nModified", Value: 0},
+		))
+
+		tookOver, err := takeOverStaleLock(mt.Ctx, mt.Coll)
+		if err != nil {
+			t.Fatalf("takeOverStaleLock returned an error: %v", err)
+		}
+		if tookOver {
+			t.Error("takeOverStaleLock() = true, want false when nothing matched the staleness filter")
+		}
+	})
+}
+
+func TestAcquireLockSucceedsOnFirstInsert(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("lock acquired", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+
+		unlock, err := acquireLock(mt.Ctx, mt.DB)
+		if err != nil {
+			t.Fatalf("acquireLock returned an error: %v", err)
+		}
+		if unlock == nil {
+			t.Error("acquireLock returned a nil unlock func")
+		}
+	})
+}
@@ -0,0 +1,95 @@
+/*
+ *
+ * Copyright 2023 puzzleblogserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package blogserver
+
+import (
+	"context"
+	"time"
+
+	"github.com/dvaumoron/puzzleblogserver/activitypub"
+	pb "github.com/dvaumoron/puzzleblogservice"
+	mongoclient "github.com/dvaumoron/puzzlemongoclient"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+const scheduledPublishPollInterval = 30 * time.Second
+
+// startScheduledPublisher periodically promotes SCHEDULED posts whose publishAt
+// has elapsed to PUBLISHED, firing the ActivityPub hook if federation is enabled.
+func (s *server) startScheduledPublisher(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(scheduledPublishPollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.promoteScheduledPosts(ctx)
+			}
+		}
+	}()
+}
+
+func (s *server) promoteScheduledPosts(ctx context.Context) {
+	logger := s.logger.Ctx(ctx)
+	collection := s.mongoPool.Client().Database(s.databaseName).Collection(collectionName)
+	filter := bson.D{
+		{Key: statusKey, Value: pb.PostStatus_SCHEDULED},
+		{Key: publishAtKey, Value: bson.D{{Key: "$lte", Value: uint64(time.Now().Unix())}}},
+	}
+
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		logger.Error(mongoCallMsg, zap.Error(err))
+		return
+	}
+
+	var duePosts []bson.M
+	if err = cursor.All(ctx, &duePosts); err != nil {
+		logger.Error(mongoCallMsg, zap.Error(err))
+		return
+	}
+
+	for _, post := range duePosts {
+		s.publishDuePost(ctx, collection, post)
+	}
+}
+
+func (s *server) publishDuePost(ctx context.Context, collection *mongo.Collection, post bson.M) {
+	logger := s.logger.Ctx(ctx)
+	blogId := mongoclient.ExtractUint64(post[blogIdKey])
+	postId := mongoclient.ExtractUint64(post[postIdKey])
+
+	postFilter := bson.D{{Key: blogIdKey, Value: blogId}, {Key: postIdKey, Value: postId}}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: statusKey, Value: pb.PostStatus_PUBLISHED}}}}
+	if _, err := collection.UpdateOne(ctx, postFilter, update); err != nil {
+		logger.Error(mongoCallMsg, zap.Error(err))
+		return
+	}
+
+	if s.federation != nil {
+		title, _ := post[titleKey].(string)
+		text, _ := post[textKey].(string)
+		s.federation.Publish(ctx, blogId, activitypub.CreateActivity, s.federation.ToArticle(blogId, postId, title, text))
+	}
+}
@@ -0,0 +1,136 @@
+/*
+ *
+ * Copyright 2023 puzzleblogserver authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package mongopool holds a single pooled, health-checked mongo client shared
+// by every subsystem of this instance (blogserver and the optional
+// activitypub federation package), instead of each one dialing its own
+// connection per call.
+package mongopool
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/uptrace/opentelemetry-go-extra/otelzap"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+const pingInterval = 15 * time.Second
+const pingTimeout = 5 * time.Second
+
+// Pool holds the shared, pooled mongo client, reconnecting in the background
+// when the connection is lost instead of requiring a process restart.
+type Pool struct {
+	clientOptions *options.ClientOptions
+
+	mu      sync.RWMutex
+	client  *mongo.Client
+	healthy bool
+}
+
+// New connects and pings clientOptions, returning a Pool ready to share.
+func New(ctx context.Context, clientOptions *options.ClientOptions) (*Pool, error) {
+	client, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		return nil, err
+	}
+	if err = client.Ping(ctx, nil); err != nil {
+		return nil, err
+	}
+	return &Pool{clientOptions: clientOptions, client: client, healthy: true}, nil
+}
+
+// Client returns the current client. It may briefly be stale while a reconnect
+// is in flight, in which case calls made through it fail; they are not retried.
+func (p *Pool) Client() *mongo.Client {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.client
+}
+
+func (p *Pool) Healthy() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.healthy
+}
+
+// Watch periodically pings the pool and reconnects on failure, until ctx is done.
+func (p *Pool) Watch(ctx context.Context, logger *otelzap.Logger) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.checkAndReconnect(ctx, logger)
+		}
+	}
+}
+
+func (p *Pool) checkAndReconnect(ctx context.Context, logger *otelzap.Logger) {
+	pingCtx, cancel := context.WithTimeout(ctx, pingTimeout)
+	err := p.Client().Ping(pingCtx, nil)
+	cancel()
+	if err == nil {
+		p.setHealthy(true)
+		return
+	}
+
+	logger.Ctx(ctx).Error("Mongo health check failed, attempting reconnect", zap.Error(err))
+	p.setHealthy(false)
+
+	client, err := mongo.Connect(ctx, p.clientOptions)
+	if err != nil {
+		logger.Ctx(ctx).Error("Mongo reconnect failed", zap.Error(err))
+		return
+	}
+
+	pingCtx, cancel = context.WithTimeout(ctx, pingTimeout)
+	err = client.Ping(pingCtx, nil)
+	cancel()
+	if err != nil {
+		logger.Ctx(ctx).Error("Mongo reconnect ping failed", zap.Error(err))
+		return
+	}
+
+	p.mu.Lock()
+	old := p.client
+	p.client, p.healthy = client, true
+	p.mu.Unlock()
+
+	disconnectCtx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	if err = old.Disconnect(disconnectCtx); err != nil {
+		logger.Ctx(ctx).Error("Failed to disconnect stale Mongo client", zap.Error(err))
+	}
+}
+
+func (p *Pool) setHealthy(healthy bool) {
+	p.mu.Lock()
+	p.healthy = healthy
+	p.mu.Unlock()
+}
+
+func (p *Pool) Disconnect(ctx context.Context) error {
+	return p.Client().Disconnect(ctx)
+}
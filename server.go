@@ -19,20 +19,54 @@
 package main
 
 import (
+	"context"
 	_ "embed"
+	"os"
 
+	"github.com/dvaumoron/puzzleblogserver/activitypub"
 	"github.com/dvaumoron/puzzleblogserver/blogserver"
+	"github.com/dvaumoron/puzzleblogserver/mongopool"
 	pb "github.com/dvaumoron/puzzleblogservice"
 	grpcserver "github.com/dvaumoron/puzzlegrpcserver"
 	mongoclient "github.com/dvaumoron/puzzlemongoclient"
+	"go.uber.org/zap"
 )
 
 //go:embed version.txt
 var version string
 
+// PUZZLE_FEDERATION_URL enables the optional ActivityPub subsystem when set to the
+// public base URL of this instance (e.g. "https://blog.example.com").
+const federationBaseURLEnv = "PUZZLE_FEDERATION_URL"
+
 func main() {
 	s := grpcserver.Make(blogserver.BlogKey, version)
 	clientOptions, databaseName := mongoclient.Create()
-	pb.RegisterBlogServer(s, blogserver.New(clientOptions, databaseName, s.Logger))
+
+	ctx := context.Background()
+	pool, err := mongopool.New(ctx, clientOptions)
+	if err != nil {
+		s.Logger.Fatal("Failed to connect to MongoDB", zap.Error(err))
+	}
+	go pool.Watch(ctx, s.Logger)
+
+	var federation *activitypub.Publisher
+	if baseURL := os.Getenv(federationBaseURLEnv); baseURL != "" {
+		federation = activitypub.New(activitypub.Config{
+			Pool: pool, DatabaseName: databaseName, BaseURL: baseURL, Logger: s.Logger,
+		})
+		activitypub.NewHandler(federation).Routes(s.Mux)
+	}
+
+	blogServer, err := blogserver.New(pool, databaseName, s.Logger, federation)
+	if err != nil {
+		s.Logger.Fatal("Failed to initialize blogserver", zap.Error(err))
+	}
+	defer blogServer.Close(context.Background())
+
+	s.Mux.HandleFunc("/health", blogServer.HealthHandler)
+	s.Mux.HandleFunc("/ready", blogServer.ReadyHandler)
+
+	pb.RegisterBlogServer(s, blogServer)
 	s.Start()
 }